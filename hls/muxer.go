@@ -0,0 +1,265 @@
+// Package hls implements an HLS muxer built directly on top of the engine's
+// MemoryTs writer. It segments a Track's media on IDR boundaries, keeps each
+// .ts file independently playable by re-emitting the PAT/PMT pair into every
+// segment, and maintains a rolling .m3u8 playlist (optionally with LL-HLS
+// EXT-X-PART tags for partial segments).
+package hls
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	engine "m7s.live/engine/v4"
+	"m7s.live/engine/v4/codec/mpegts"
+	"m7s.live/engine/v4/track"
+	"m7s.live/engine/v4/util"
+)
+
+// Config 控制切片与播放列表的生成策略
+type Config struct {
+	TargetDuration time.Duration // 每个分片的目标时长，默认6s
+	Window         int           // 直播窗口保留的分片数量，0表示保留全部（点播/事件模式）
+	LLHLS          bool          // 是否开启低延迟HLS，产出EXT-X-PART
+	PartDuration   time.Duration // LL-HLS partial segment目标时长，默认TargetDuration/4
+}
+
+// part是LL-HLS的一个partial segment，复用所属segment的MemoryTs缓冲区，只记录偏移量
+type part struct {
+	byteOffset  int64
+	byteLength  int64
+	duration    time.Duration
+	independent bool // 是否以IDR开始
+}
+
+// segment是一个独立可播放的.ts分片，PAT/PMT在生成时就已经写入，因此可以单独拉取播放
+type segment struct {
+	seq      int
+	ts       engine.MemoryTs
+	pts      uint32 // 起始pts，用于计算时长
+	duration time.Duration
+	parts    []part
+	done     bool
+
+	// 正在累积、尚未凑够PartDuration的partial segment，openPartPTS是它第一帧的pts，
+	// 用来算到当前帧为止这个part实际覆盖了多久。
+	hasOpenPart         bool
+	openPartOffset      int64
+	openPartPTS         uint32
+	openPartIndependent bool
+}
+
+func (s *segment) Name() string { return fmt.Sprintf("seg%d.ts", s.seq) }
+
+// Muxer以track.Video的Play()循环作为唯一数据源进行切片，
+// 保证切出来的数据跟普通订阅者看到的是同一份数据。
+type Muxer struct {
+	Config
+	video    *track.Video
+	audio    *track.Audio
+	pmt      util.Buffer // 从外部（发布时）生成一次，此后每个分片都复用同一份PMT
+	videoPes mpegts.MpegtsPESFrame
+	audioPes mpegts.MpegtsPESFrame
+
+	lock     sync.RWMutex
+	segments []*segment
+	nextSeq  int
+}
+
+// NewMuxer创建一个绑定到指定Video轨道的HLS切片器，pmt为该节目的PAT之后紧跟的PMT原始字节，
+// 由外部(发布流程)生成一次，之后每个分片都会原样复用它，使每个.ts都能独立播放。
+//
+// MPEG-TS要求每个IDR前自带SPS/PPS(/VPS)才能独立解码，这个转换由video.Filtered()在每次
+// onVideo时现算，只影响这里拼出来的TS payload，不会碰到RTMP转发/HTTP-FLV/CMAF录制等其他
+// 订阅者共用的那份frame.Raw。EnsureH264Mp4ToAnnexBFilter确保这个bsf只挂一份，哪怕同一路流
+// 同时还有SRT输出在用同一个track.Video。
+func NewMuxer(video *track.Video, audio *track.Audio, pmt util.Buffer, config Config) *Muxer {
+	if config.TargetDuration == 0 {
+		config.TargetDuration = 6 * time.Second
+	}
+	if config.PartDuration == 0 {
+		config.PartDuration = config.TargetDuration / 4
+	}
+	video.EnsureH264Mp4ToAnnexBFilter()
+	return &Muxer{
+		Config: config,
+		video:  video,
+		audio:  audio,
+		pmt:    append(util.Buffer{}, pmt...),
+		videoPes: mpegts.MpegtsPESFrame{
+			Pid: mpegts.PID_VIDEO,
+		},
+		audioPes: mpegts.MpegtsPESFrame{
+			Pid: mpegts.PID_AUDIO,
+		},
+	}
+}
+
+// Run阻塞式地消费Video.Play()，直到流结束；应当在独立的goroutine中调用。
+func (m *Muxer) Run() {
+	if m.audio != nil {
+		go m.audio.Play(m.onAudio)
+	}
+	m.video.Play(m.onVideo)
+}
+
+func (m *Muxer) current() *segment {
+	if l := len(m.segments); l > 0 {
+		return m.segments[l-1]
+	}
+	return nil
+}
+
+// cutSegment在遇到IDR时结束上一个分片并开启新的一个，新分片携带与此前相同的PAT/PMT，
+// 因此每一个.ts文件都是可以独立解码播放的。
+func (m *Muxer) cutSegment(pts uint32) *segment {
+	if cur := m.current(); cur != nil {
+		cur.done = true
+	}
+	s := &segment{seq: m.nextSeq, pts: pts}
+	s.ts.PMT = m.pmt
+	m.nextSeq++
+	m.segments = append(m.segments, s)
+	if m.Window > 0 {
+		for len(m.segments) > m.Window {
+			m.segments = m.segments[1:]
+		}
+	}
+	return s
+}
+
+func (m *Muxer) onVideo(frame *engine.VideoFrame) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	cur := m.current()
+	needNewSegment := frame.IFrame && (cur == nil || cur.duration >= m.TargetDuration)
+	if needNewSegment {
+		if cur != nil && m.LLHLS {
+			// 上一个分片到此为止，把它身上还没攒够PartDuration的尾巴也收成一个part，
+			// 否则这一小段数据就永远不会出现在播放列表里。
+			m.closeOpenPart(cur, int64(util.SizeOfBuffers(cur.ts.BLL.ToBuffers())), frame.PTS)
+		}
+		cur = m.cutSegment(frame.PTS)
+	} else if cur == nil {
+		return nil // 还没有过IDR，无法开始分片
+	} else {
+		// 持续更新当前分片已经覆盖的时长，这样下一个IDR到来时才能正确判断是否超过
+		// TargetDuration；只在切片时赋值的话cur.duration永远停在0，永远切不出第二段。
+		cur.duration = time.Duration(frame.PTS-cur.pts) * time.Millisecond / 90
+	}
+
+	partStart := util.SizeOfBuffers(cur.ts.BLL.ToBuffers())
+	m.videoPes.IsKeyFrame = frame.IFrame
+	m.videoPes.ProgramClockReferenceBase = uint64(frame.DTS)
+	// 拼一份只供这个TS分片使用的annexB帧：Filtered()把SPS/PPS(/VPS)插到IDR前面，
+	// 但写回的是局部拷贝的Raw，不会影响frame本身（其他订阅者还要用原样的Raw）。
+	annexBFrame := *frame
+	annexBFrame.Raw = m.video.Filtered(frame)
+	if err := cur.ts.WriteVideoFrame(&annexBFrame, nil, &m.videoPes); err != nil {
+		return err
+	}
+
+	if m.LLHLS {
+		if !cur.hasOpenPart {
+			cur.hasOpenPart = true
+			cur.openPartOffset = int64(partStart)
+			cur.openPartPTS = frame.PTS
+			cur.openPartIndependent = frame.IFrame
+		}
+		// 攒够一个PartDuration才收尾，真实span用这一批帧实际跨越的pts差值，
+		// 而不是不管这一批到底攒了几帧、跨了多久都照抄配置里的PartDuration。
+		elapsed := time.Duration(frame.PTS-cur.openPartPTS) * time.Millisecond / 90
+		if elapsed >= m.PartDuration {
+			partEnd := util.SizeOfBuffers(cur.ts.BLL.ToBuffers())
+			cur.parts = append(cur.parts, part{
+				byteOffset:  cur.openPartOffset,
+				byteLength:  int64(partEnd) - cur.openPartOffset,
+				duration:    elapsed,
+				independent: cur.openPartIndependent,
+			})
+			cur.hasOpenPart = false
+		}
+	}
+	return nil
+}
+
+// closeOpenPart把s身上还没凑够PartDuration、尚未收尾的那个partial segment强制收尾，
+// 用于分片切换这类"到此为止"的时机：atPTS是触发收尾的那一刻的pts(通常是下一个分片
+// 首帧的pts)，atByteOffset是s的TS缓冲区此刻的总长度。
+func (m *Muxer) closeOpenPart(s *segment, atByteOffset int64, atPTS uint32) {
+	if !s.hasOpenPart {
+		return
+	}
+	s.parts = append(s.parts, part{
+		byteOffset:  s.openPartOffset,
+		byteLength:  atByteOffset - s.openPartOffset,
+		duration:    time.Duration(atPTS-s.openPartPTS) * time.Millisecond / 90,
+		independent: s.openPartIndependent,
+	})
+	s.hasOpenPart = false
+}
+
+func (m *Muxer) onAudio(frame *engine.AudioFrame) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	cur := m.current()
+	if cur == nil {
+		return nil // 音频在第一个视频IDR分片之前的数据直接丢弃
+	}
+	return cur.ts.WriteAudioFrame(frame, m.audio.AudioSpecificConfig, &m.audioPes)
+}
+
+// Playlist生成当前的滚动m3u8播放列表
+func (m *Muxer) Playlist() string {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+
+	var b strings.Builder
+	b.WriteString("#EXTM3U\n")
+	b.WriteString("#EXT-X-VERSION:6\n")
+	fmt.Fprintf(&b, "#EXT-X-TARGETDURATION:%d\n", int(m.TargetDuration.Seconds()+0.5))
+	if len(m.segments) > 0 {
+		fmt.Fprintf(&b, "#EXT-X-MEDIA-SEQUENCE:%d\n", m.segments[0].seq)
+	}
+	if m.LLHLS {
+		fmt.Fprintf(&b, "#EXT-X-PART-INF:PART-TARGET=%.3f\n", m.PartDuration.Seconds())
+	}
+	for _, s := range m.segments {
+		if !s.done {
+			// 正在写的这个分片还没收尾，cur.duration会随着每一帧改变，它的字节也可能
+			// 被下一帧追加：标准(非LL)HLS播放列表不能把它当成一个完整分片列出来，
+			// 否则客户端此刻拉到的EXTINF时长和实际字节对不上。LL-HLS下改成把它已经
+			// 攒好的partial segment列出来，方便客户端低延迟拉取。
+			if m.LLHLS {
+				for _, p := range s.parts {
+					fmt.Fprintf(&b, "#EXT-X-PART:DURATION=%.3f,URI=\"%s\",BYTERANGE=%d@%d%s\n",
+						p.duration.Seconds(), s.Name(), p.byteLength, p.byteOffset, independentAttr(p.independent))
+				}
+			}
+			continue
+		}
+		fmt.Fprintf(&b, "#EXTINF:%.3f,\n%s\n", s.duration.Seconds(), s.Name())
+	}
+	return b.String()
+}
+
+func independentAttr(independent bool) string {
+	if independent {
+		return ",INDEPENDENT=YES"
+	}
+	return ""
+}
+
+// Segment按文件名查找一个已经切好的分片，供HTTP层直接WriteTo响应体。
+func (m *Muxer) Segment(name string) (*segment, bool) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	for _, s := range m.segments {
+		if s.Name() == name {
+			return s, true
+		}
+	}
+	return nil, false
+}
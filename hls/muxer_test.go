@@ -0,0 +1,49 @@
+package hls
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// Playlist()只应该把已经done的分片列成#EXTINF，正在写的那个分片(done==false)的
+// duration会随每一帧改变、字节也可能被下一帧追加，标准(非LL)HLS下不能把它当完整
+// 分片列出来；LL-HLS下则改成把它已经收尾的partial segment列出来。
+func TestPlaylistOmitsInProgressSegmentInNonLLHLS(t *testing.T) {
+	m := &Muxer{Config: Config{TargetDuration: 6 * time.Second}}
+	m.segments = []*segment{
+		{seq: 0, duration: 6 * time.Second, done: true},
+		{seq: 1, duration: 3 * time.Second, done: false}, // 还在写
+	}
+
+	playlist := m.Playlist()
+	if !strings.Contains(playlist, "seg0.ts") {
+		t.Errorf("playlist should list the finished segment seg0.ts:\n%s", playlist)
+	}
+	if strings.Contains(playlist, "seg1.ts") {
+		t.Errorf("playlist should not list the in-progress segment seg1.ts:\n%s", playlist)
+	}
+}
+
+// LL-HLS下，正在写的分片即便没有done，也要把它已经收尾的partial segment列出来，
+// 这样客户端才能低延迟地拉到最新数据。
+func TestPlaylistListsOpenPartsInLLHLS(t *testing.T) {
+	m := &Muxer{Config: Config{TargetDuration: 6 * time.Second, LLHLS: true, PartDuration: 2 * time.Second}}
+	m.segments = []*segment{
+		{
+			seq:  0,
+			done: false,
+			parts: []part{
+				{byteOffset: 0, byteLength: 100, duration: 2 * time.Second, independent: true},
+			},
+		},
+	}
+
+	playlist := m.Playlist()
+	if !strings.Contains(playlist, `#EXT-X-PART:DURATION=2.000,URI="seg0.ts",BYTERANGE=100@0,INDEPENDENT=YES`) {
+		t.Errorf("playlist should list the open segment's completed part:\n%s", playlist)
+	}
+	if strings.Contains(playlist, "#EXTINF") {
+		t.Errorf("an in-progress segment should never get an #EXTINF line, even in LL-HLS:\n%s", playlist)
+	}
+}
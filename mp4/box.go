@@ -0,0 +1,52 @@
+// Package mp4 assembles CMAF-compatible fragmented MP4 (fMP4) next to the
+// engine's existing MemoryTs path: a one-off ftyp+moov init segment derived
+// from SPSInfo/AudioSpecificConfig, plus one moof+mdat fragment per sample
+// for low latency, suitable for both DASH and LL-HLS.
+package mp4
+
+import "encoding/binary"
+
+// box按ISO/IEC 14496-12的规则拼出一个大端长度前缀的box：4字节大小 + 4字节类型 + 内容，
+// 内容可以是若干个子box拼接起来的字节串。
+func box(boxType string, payload ...[]byte) []byte {
+	size := 8
+	for _, p := range payload {
+		size += len(p)
+	}
+	buf := make([]byte, 8, size)
+	binary.BigEndian.PutUint32(buf, uint32(size))
+	copy(buf[4:8], boxType)
+	for _, p := range payload {
+		buf = append(buf, p...)
+	}
+	return buf
+}
+
+func u8(v uint8) []byte { return []byte{v} }
+
+func u16(v uint16) []byte {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, v)
+	return b
+}
+
+func u24(v uint32) []byte {
+	return []byte{byte(v >> 16), byte(v >> 8), byte(v)}
+}
+
+func u32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+func u64(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
+
+// fullBox是version=0、flags=flags的full box前缀(ISO/IEC 14496-12 4.2)
+func fullBox(boxType string, flags uint32, payload ...[]byte) []byte {
+	return box(boxType, append([][]byte{u32(flags)}, payload...)...)
+}
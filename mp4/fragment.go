@@ -0,0 +1,81 @@
+package mp4
+
+import "m7s.live/engine/v4/common"
+
+// sampleFlags按ISO/IEC 14496-12 8.8.3.1编码trun里每个样本的sample_flags：
+// 非关键帧样本标记is_non_sync_sample=1，关键帧则全部置0（sample_depends_on等留给解码器按需推断）。
+func sampleFlags(isIFrame bool) uint32 {
+	if isIFrame {
+		return 0x02000000
+	}
+	return 0x01010000
+}
+
+// trunFlags: data-offset-present | sample-duration-present | sample-size-present | sample-flags-present | sample-composition-time-offsets-present
+const trunFlags = 0x000001 | 0x000100 | 0x000200 | 0x000400 | 0x000800
+
+// FillFragment为一个AVFrame组装出moof+mdat，一个分片只装一个样本，满足LL-HLS/CMAF对低延迟的要求。
+// tfdt直接使用AVFrame的DTS（90kHz时钟，跟defaultTimescale一致，不需要换算），
+// trun的sample_composition_time_offset取PTS-DTS，sample_duration由调用方传入
+// （通常是这一帧与上一帧DTS之差，首帧取TargetDuration的估计值）。
+func FillFragment(trackID uint32, seq uint32, frame *common.AVFrame[common.NALUSlice], duration uint32) []byte {
+	sampleSize := uint32(0)
+	for _, nalu := range frame.Raw {
+		sampleSize += 4 // 每个NALU前面补4字节长度，拼成AVCC帧；长度前缀只加一次，不是每个底层fragment各加一次
+		for _, b := range nalu {
+			sampleSize += uint32(len(b))
+		}
+	}
+
+	mfhd := fullBox("mfhd", 0, u32(seq))
+	tfhd := fullBox("tfhd", 0x020000, u32(trackID)) // flags=default-base-is-moof
+	tfdt := fullBox("tfdt", 0x01000000, u64(uint64(frame.DTS))) // version=1（位于最高字节），baseMediaDecodeTime是64位
+
+	cto := int32(frame.PTS - frame.DTS)
+	trun := fullBox("trun", trunFlags,
+		u32(1), // sample_count
+		u32(0), // data_offset，下面按moof实际长度回填
+		u32(duration),
+		u32(sampleSize),
+		u32(sampleFlags(frame.IFrame)),
+		u32(uint32(cto)),
+	)
+
+	traf := box("traf", tfhd, tfdt, trun)
+	moof := box("moof", mfhd, traf)
+
+	// data_offset是从moof开头到mdat负载开头的字节数，这里moof长度已经固定，直接回填
+	dataOffset := uint32(len(moof) + 8)
+	patchTrunDataOffset(moof, dataOffset)
+
+	mdat := box("mdat", avccPayload(frame)...)
+	return append(moof, mdat...)
+}
+
+// avccPayload把这一帧的NALU按4字节长度前缀拼接，跟AVCC/mp4的sample格式完全一致。
+func avccPayload(frame *common.AVFrame[common.NALUSlice]) [][]byte {
+	var out [][]byte
+	for _, nalu := range frame.Raw {
+		raw := common.NALUSlice(nalu).ToBytes()
+		out = append(out, u32(uint32(len(raw))), raw)
+	}
+	return out
+}
+
+// patchTrunDataOffset在trun box内找到data_offset字段并原地回填，
+// 省去为了一个字段重新拼一遍moof的开销。trun固定在moof末尾（traf的最后一个box），
+// data_offset固定在trun的 fullbox头(4) + sample_count(4) 之后。
+func patchTrunDataOffset(moof []byte, offset uint32) {
+	n := len(moof)
+	// trun是traf里的最后一个box，而traf又是moof里的最后一个box，所以可以从moof末尾倒推：
+	// trun的内容是 fullbox头(4字节flags) + sample_count(4) + data_offset(4) + 单样本的
+	// duration/size/flags/cto(4*4=16)，data_offset就在整个moof倒数第20字节处。
+	pos := n - 20
+	if pos < 0 || pos+4 > n {
+		return
+	}
+	moof[pos] = byte(offset >> 24)
+	moof[pos+1] = byte(offset >> 16)
+	moof[pos+2] = byte(offset >> 8)
+	moof[pos+3] = byte(offset)
+}
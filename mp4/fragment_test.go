@@ -0,0 +1,45 @@
+package mp4
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"m7s.live/engine/v4/common"
+)
+
+// trun的sample_size必须等于mdat里实际写入的字节数：avccPayload每个NALU只补一次4字节
+// 长度前缀，不管这个NALU底层由几段[]byte拼成；sample_size的统计口径得跟它完全一致，
+// 否则下游demuxer如果信任trun而不是扫描到下一个box，会在应该结束的地方继续读，读出
+// 垃圾或者提前截断。这里故意让第一个NALU由两段fragment拼成，覆盖之前按fragment而不是
+// 按NALU计数4字节前缀的那个bug。
+func TestFillFragmentSampleSizeMatchesMdatPayload(t *testing.T) {
+	fragA := []byte{0x65, 0x01, 0x02}
+	fragB := []byte{0x03, 0x04}
+	fragC := []byte{0x41, 0xAA}
+	frame := common.AVFrame[common.NALUSlice]{
+		PTS:    1000,
+		DTS:    900,
+		IFrame: true,
+		Raw: []common.NALUSlice{
+			{fragA, fragB},
+			{fragC},
+		},
+	}
+
+	wantSampleSize := uint32(4+len(fragA)+len(fragB)) + uint32(4+len(fragC))
+	wantMdatPayloadSize := int(wantSampleSize)
+
+	out := FillFragment(1, 1, &frame, 3000)
+
+	mdatLen := 8 + wantMdatPayloadSize // mdat box header(8) + 实际payload
+	moofLen := len(out) - mdatLen
+	if moofLen < 20 {
+		t.Fatalf("moof too short (%d bytes) to contain trun's fixed tail", moofLen)
+	}
+	// trun布局跟patchTrunDataOffset依赖的是同一套固定偏移：data_offset在moof末尾往前20字节，
+	// duration紧随其后(-16)，sample_size在duration之后(-12)。
+	gotSampleSize := binary.BigEndian.Uint32(out[moofLen-12 : moofLen-8])
+	if gotSampleSize != wantSampleSize {
+		t.Errorf("trun sample_size = %d, want %d (mdat actually holds %d bytes)", gotSampleSize, wantSampleSize, wantMdatPayloadSize)
+	}
+}
@@ -0,0 +1,198 @@
+package mp4
+
+import (
+	"m7s.live/engine/v4/codec"
+	"m7s.live/engine/v4/common"
+)
+
+// defaultTimescale固定用90kHz，跟引擎内部AVFrame.PTS/DTS沿用的MPEG时钟单位一致，
+// tfdt/trun可以直接拿PTS/DTS使用，不需要额外换算。
+const defaultTimescale = 90000
+
+// InitSegment生成一个CMAF/fMP4的初始化分片(ftyp+moov)，由H.264/H.265的SPSInfo和AAC的
+// AudioSpecificConfig推导出avc1/hvc1与mp4a的sample entry，不含任何媒体样本，
+// 只需要在编解码参数第一次确定（或变化）时生成一次，后续每个moof+mdat都可以独立于它被拉取。
+func InitSegment(videoCodec codec.VideoCodecID, sps codec.SPSInfo, paramaterSets common.ParamaterSets, asc *codec.AudioSpecificConfig) []byte {
+	ftyp := box("ftyp",
+		[]byte("isom"), u32(512),
+		[]byte("isom"), []byte("iso6"), []byte("msdh"), []byte("msix"),
+	)
+	return append(ftyp, buildMoov(1, videoCodec, sps, paramaterSets, 2, asc)...)
+}
+
+// buildMoov按 mvhd, trak(video)[, trak(audio)], mvex 的顺序拼出moov，
+// mvex/trex是fMP4(CMAF)必须有的，声明每个track的默认样本时长/大小，
+// 配合moof里的tfhd/trun让每个分片都能独立解析。
+func buildMoov(videoTrackID uint32, videoCodec codec.VideoCodecID, sps codec.SPSInfo, paramaterSets common.ParamaterSets, audioTrackID uint32, asc *codec.AudioSpecificConfig) []byte {
+	parts := [][]byte{mvhd(), videoTrak(videoTrackID, videoCodec, sps, paramaterSets)}
+	trex := [][]byte{trexTrack(videoTrackID)}
+	if asc != nil {
+		parts = append(parts, audioTrak(audioTrackID, asc))
+		trex = append(trex, trexTrack(audioTrackID))
+	}
+	parts = append(parts, box("mvex", trex...))
+	return box("moov", parts...)
+}
+
+func mvhd() []byte {
+	return fullBox("mvhd", 0,
+		u32(0), u32(0), // creation/modification time
+		u32(defaultTimescale), u32(0), // timescale, duration(fMP4下交给moof，这里写0)
+		u32(0x00010000), u16(0x0100), u16(0), // rate, volume, reserved
+		u32(0), u32(0), // reserved
+		// unity matrix
+		u32(0x00010000), u32(0), u32(0),
+		u32(0), u32(0x00010000), u32(0),
+		u32(0), u32(0), u32(0x40000000),
+		u32(0), u32(0), u32(0), u32(0), u32(0), u32(0), // pre_defined
+		u32(0xFFFFFFFF), // next_track_ID
+	)
+}
+
+func trexTrack(trackID uint32) []byte {
+	return fullBox("trex", 0,
+		u32(trackID),
+		u32(1), // default_sample_description_index
+		u32(0), // default_sample_duration，实际时长由trun逐样本携带
+		u32(0), // default_sample_size
+		u32(0), // default_sample_flags
+	)
+}
+
+func videoTrak(trackID uint32, videoCodec codec.VideoCodecID, sps codec.SPSInfo, paramaterSets common.ParamaterSets) []byte {
+	tkhd := fullBox("tkhd", 7, // flags=7: track_enabled|in_movie|in_preview
+		u32(0), u32(0), u32(trackID), u32(0), u32(0),
+		u32(0), u32(0), u16(0), u16(0), // duration, reserved, layer, alternate_group
+		u16(0), u16(0), // volume, reserved
+		u32(0x00010000), u32(0), u32(0),
+		u32(0), u32(0x00010000), u32(0),
+		u32(0), u32(0), u32(0x40000000),
+		u32(uint32(sps.Width)<<16), u32(uint32(sps.Height)<<16),
+	)
+	mdhd := fullBox("mdhd", 0, u32(0), u32(0), u32(defaultTimescale), u32(0), u16(0x55C4), u16(0))
+	hdlr := box("hdlr", u32(0), []byte("\x00\x00\x00\x00"), []byte("vide"), u32(0), u32(0), u32(0), []byte("VideoHandler\x00"))
+	stsd := videoStsd(videoCodec, sps, paramaterSets)
+	stbl := box("stbl", stsd, emptyTable("stts"), emptyTable("stsc"), emptySampleSizeTable(), emptyTable("stco"))
+	minf := box("minf", box("vmhd", []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}), box("dinf", box("dref", u32(1), fullBox("url ", 1))), stbl)
+	mdia := box("mdia", mdhd, hdlr, minf)
+	return box("trak", tkhd, mdia)
+}
+
+func audioTrak(trackID uint32, asc *codec.AudioSpecificConfig) []byte {
+	tkhd := fullBox("tkhd", 7,
+		u32(0), u32(0), u32(trackID), u32(0), u32(0),
+		u32(0), u32(0), u16(0), u16(0),
+		u16(0x0100), u16(0),
+		u32(0x00010000), u32(0), u32(0),
+		u32(0), u32(0x00010000), u32(0),
+		u32(0), u32(0), u32(0x40000000),
+		u32(0), u32(0),
+	)
+	mdhd := fullBox("mdhd", 0, u32(0), u32(0), u32(uint32(asc.SampleRate)), u32(0), u16(0x55C4), u16(0))
+	hdlr := box("hdlr", u32(0), []byte("\x00\x00\x00\x00"), []byte("soun"), u32(0), u32(0), u32(0), []byte("SoundHandler\x00"))
+	stsd := audioStsd(asc)
+	stbl := box("stbl", stsd, emptyTable("stts"), emptyTable("stsc"), emptySampleSizeTable(), emptyTable("stco"))
+	minf := box("minf", box("smhd", u16(0), u16(0)), box("dinf", box("dref", u32(1), fullBox("url ", 1))), stbl)
+	mdia := box("mdia", mdhd, hdlr, minf)
+	return box("trak", tkhd, mdia)
+}
+
+// videoStsd根据CodecID写出avc1(H.264)或hvc1(H.265)的sample entry，
+// 内嵌的avcC/hvcC携带当前缓存的SPS/PPS(/VPS)，解码器靠它们还原参数集。
+func videoStsd(videoCodec codec.VideoCodecID, sps codec.SPSInfo, paramaterSets common.ParamaterSets) []byte {
+	visualSampleEntry := func(format string, configBox []byte) []byte {
+		return box(format,
+			make([]byte, 6), u16(1), // reserved, data_reference_index
+			u16(0), u16(0), u32(0), u32(0), u32(0), // pre_defined/reserved
+			u16(uint16(sps.Width)), u16(uint16(sps.Height)),
+			u32(0x00480000), u32(0x00480000), // 72dpi水平/垂直分辨率
+			u32(0), u16(1), // reserved, frame_count
+			make([]byte, 32), // compressorname
+			u16(0x0018), u16(0xFFFF), // depth, pre_defined
+			configBox,
+		)
+	}
+	switch videoCodec {
+	case codec.CodecID_H265:
+		return box("stsd", u32(0), u32(1), visualSampleEntry("hvc1", box("hvcC", hvcCPayload(paramaterSets))))
+	default:
+		return box("stsd", u32(0), u32(1), visualSampleEntry("avc1", box("avcC", avcCPayload(paramaterSets))))
+	}
+}
+
+func audioStsd(asc *codec.AudioSpecificConfig) []byte {
+	audioSampleEntry := box("mp4a",
+		make([]byte, 6), u16(1), // reserved, data_reference_index
+		u32(0), u32(0), // reserved
+		u16(uint16(asc.ChannelCount())), u16(16), // channelcount, samplesize
+		u16(0), u16(0), // pre_defined, reserved
+		u32(uint32(asc.SampleRate)<<16),
+		box("esds", esdsPayload(asc)),
+	)
+	return box("stsd", u32(0), u32(1), audioSampleEntry)
+}
+
+// avcCPayload拼出AVCDecoderConfigurationRecord，configurationVersion固定为1，
+// profile/level直接取自当前缓存的SPS，NALU长度固定为4字节（与vt.nalulenSize约定一致）。
+func avcCPayload(paramaterSets common.ParamaterSets) []byte {
+	var sps, pps []byte
+	if len(paramaterSets) > 0 {
+		sps = common.NALUSlice(paramaterSets[0]).ToBytes()
+	}
+	if len(paramaterSets) > 1 {
+		pps = common.NALUSlice(paramaterSets[1]).ToBytes()
+	}
+	profile, compat, level := byte(0x64), byte(0), byte(0x1F)
+	if len(sps) > 3 {
+		profile, compat, level = sps[1], sps[2], sps[3]
+	}
+	buf := []byte{1, profile, compat, level, 0xFF, 0xE1}
+	buf = append(buf, u16(uint16(len(sps)))...)
+	buf = append(buf, sps...)
+	buf = append(buf, 1)
+	buf = append(buf, u16(uint16(len(pps)))...)
+	buf = append(buf, pps...)
+	return buf
+}
+
+// hvcCPayload是HEVCDecoderConfigurationRecord的精简版本：把VPS/SPS/PPS各自放进一个array，
+// 省略了大部分只在解码器选型时才需要的字段，留空/填0。每个array entry的NAL类型从这条NALU
+// 自己的头部解析出来，而不是从它在paramaterSets里的下标推断——调用方缓存的参数集不保证
+// 总是凑齐VPS+SPS+PPS三条（比如只重新宣告了SPS/PPS），按下标推断在那种情况下会把SPS
+// 错标成VPS。
+func hvcCPayload(paramaterSets common.ParamaterSets) []byte {
+	buf := []byte{1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 3}
+	buf = append(buf, byte(len(paramaterSets)))
+	for _, ps := range paramaterSets {
+		raw := common.NALUSlice(ps).ToBytes()
+		var naluType byte
+		if len(raw) > 0 {
+			naluType = (raw[0] >> 1) & 0x3F // 实际解析出的VPS(32)/SPS(33)/PPS(34)
+		}
+		buf = append(buf, naluType, 0, 1)
+		buf = append(buf, u16(uint16(len(raw)))...)
+		buf = append(buf, raw...)
+	}
+	return buf
+}
+
+// esdsPayload包装AAC的AudioSpecificConfig为ES_Descriptor，供mp4a的stsd使用。
+func esdsPayload(asc *codec.AudioSpecificConfig) []byte {
+	ascBytes := asc.ToBytes()
+	decSpecificInfo := append([]byte{0x05, byte(len(ascBytes))}, ascBytes...)
+	decConfigDescr := append([]byte{0x04, byte(13 + len(decSpecificInfo))}, []byte{0x40, 0x15, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}...)
+	decConfigDescr = append(decConfigDescr, decSpecificInfo...)
+	esDescr := append([]byte{0x03, byte(3 + len(decConfigDescr) + 3)}, u16(0)...)
+	esDescr = append(esDescr, 0) // flags
+	esDescr = append(esDescr, decConfigDescr...)
+	esDescr = append(esDescr, 0x06, 0x01, 0x02) // SLConfigDescriptor
+	return append(u32(0), esDescr...)
+}
+
+func emptyTable(boxType string) []byte {
+	return fullBox(boxType, 0, u32(0))
+}
+
+func emptySampleSizeTable() []byte {
+	return fullBox("stsz", 0, u32(0), u32(0))
+}
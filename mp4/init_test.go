@@ -0,0 +1,42 @@
+package mp4
+
+import (
+	"testing"
+
+	"m7s.live/engine/v4/common"
+)
+
+// hvcCPayload必须按每条NALU自己解析出来的NAL类型打标，而不是按它在paramaterSets里的
+// 下标猜VPS/SPS/PPS：HEVC编码器常见的做法是只在第一个IDR宣告一次VPS，之后的IDR只
+// 重新宣告SPS/PPS，调用方缓存的参数集这时候就只剩两条、顺序也不保证是VPS,SPS,PPS——
+// 这里故意把SPS放在第一位、VPS放在第二位来覆盖这种情况。
+func TestHvcCPayloadLabelsByParsedNALType(t *testing.T) {
+	sps := []byte{0x42, 0x01} // naluType = (0x42>>1)&0x3F = 33 (SPS)
+	vps := []byte{0x40, 0x01} // naluType = (0x40>>1)&0x3F = 32 (VPS)
+	paramaterSets := common.ParamaterSets{
+		common.NALUSlice{sps},
+		common.NALUSlice{vps},
+	}
+
+	buf := hvcCPayload(paramaterSets)
+
+	const fixedPrefixLen = 23 // 22字节固定头 + 1字节numOfArrays
+	numOfArrays := int(buf[fixedPrefixLen-1])
+	if numOfArrays != len(paramaterSets) {
+		t.Fatalf("numOfArrays = %d, want %d", numOfArrays, len(paramaterSets))
+	}
+
+	pos := fixedPrefixLen
+	wantTypes := []byte{33, 32} // 按实际解析出来的类型，而不是按下标0=VPS,1=SPS的老假设
+	for i, want := range wantTypes {
+		naluType := buf[pos]
+		nalLen := int(buf[pos+3])<<8 | int(buf[pos+4])
+		if naluType != want {
+			t.Errorf("entry %d: naluType = %d, want %d", i, naluType, want)
+		}
+		pos += 5 + nalLen
+	}
+	if pos != len(buf) {
+		t.Errorf("consumed %d bytes parsing entries, buffer is %d bytes", pos, len(buf))
+	}
+}
@@ -0,0 +1,152 @@
+// Package srt exposes MPEG-TS over SRT as a plugin-style transport for the
+// engine: a Publisher pushes a Stream out as an SRT stream (listener or
+// caller mode), and a Puller does the reverse, pulling an SRT/TS stream in
+// and feeding it to the track layer.
+package srt
+
+import (
+	"context"
+	"sync"
+
+	srt "github.com/datarhei/gosrt"
+
+	engine "m7s.live/engine/v4"
+	"m7s.live/engine/v4/codec/mpegts"
+	"m7s.live/engine/v4/track"
+	"m7s.live/engine/v4/util"
+)
+
+// srtPayloadSize是单次SRT发送的载荷大小，7个188字节的TS包刚好凑够1316字节，
+// 不超过典型MTU(1500)减去SRT/UDP/IP头部之后的可用空间。
+const srtPacketsPerPayload = 7
+const srtPayloadSize = srtPacketsPerPayload * mpegts.TS_PACKET_SIZE
+
+// Mode决定发布时SRT是作为server(listener)等待对端连接，还是作为client(caller)主动连接对端。
+type Mode int
+
+const (
+	ModeListener Mode = iota
+	ModeCaller
+)
+
+// Config是发布一路SRT/TS所需的连接参数
+type Config struct {
+	Mode    Mode
+	Addr    string // listener模式下监听地址，caller模式下对端地址
+	StreamID string // SRT streamid，用于caller/listener两端协商路径
+}
+
+// Publisher把一个Stream的Video/Audio轨道重新打包为MPEG-TS，通过SRT推送出去，
+// 复用MemoryTs.WritePESPacket完成PES->TS的封装，PCR统一在遇到IDR帧时刷新。
+//
+// video.Play/audio.Play各自跑在自己的goroutine里，因此音视频各自持有独立的
+// MemoryTs/pending缓冲，互不干扰；两条goroutine都会把编码好的字节写进同一个
+// SRT连接，writeMu只用来序列化这最后一步conn.Write，避免两路数据在连接上交叉。
+type Publisher struct {
+	Config
+	video        *track.Video
+	audio        *track.Audio
+	videoPes     mpegts.MpegtsPESFrame
+	audioPes     mpegts.MpegtsPESFrame
+	videoTs      engine.MemoryTs
+	videoPending util.Buffer // 不足7个TS包(1316字节)的尾部，留到下次flush再一起发送
+	audioTs      engine.MemoryTs
+	audioPending util.Buffer
+	writeMu      sync.Mutex
+}
+
+// NewPublisher创建一个绑定到指定Video/Audio轨道的SRT推流器。
+//
+// MPEG-TS要求每个IDR前自带SPS/PPS(/VPS)才能独立解码；这个转换只应用在喂给WriteVideoFrame
+// 的那份局部拷贝上(见Run里的video.Filtered调用)，不会碰到video.Value.Raw本身——那是RTMP
+// 转发/HTTP-FLV/CMAF录制等其他订阅者也在用的共享数据。EnsureH264Mp4ToAnnexBFilter确保
+// 这个bsf只挂一份，哪怕同一路流同时还有HLS输出在用同一个track.Video。
+func NewPublisher(video *track.Video, audio *track.Audio, config Config) *Publisher {
+	video.EnsureH264Mp4ToAnnexBFilter()
+	return &Publisher{
+		Config: config,
+		video:  video,
+		audio:  audio,
+		videoPes: mpegts.MpegtsPESFrame{
+			Pid: mpegts.PID_VIDEO,
+		},
+		audioPes: mpegts.MpegtsPESFrame{
+			Pid: mpegts.PID_AUDIO,
+		},
+	}
+}
+
+// Run建立SRT连接（按Mode选择listen或dial），随后持续消费Video.Play()把数据喂给WritePESPacket，
+// 并将累积的TS包按7个一组(1316字节)切块发送。
+func (p *Publisher) Run(ctx context.Context) (err error) {
+	conn, err := p.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if p.audio != nil {
+		go p.audio.Play(func(frame *engine.AudioFrame) error {
+			if err := p.audioTs.WriteAudioFrame(frame, p.audio.AudioSpecificConfig, &p.audioPes); err != nil {
+				return err
+			}
+			return p.flush(conn, &p.audioTs, &p.audioPending)
+		})
+	}
+
+	return p.video.Play(func(frame *engine.VideoFrame) error {
+		if frame.IFrame {
+			// 以IDR为基准刷新PCR，保证每个GOP起始都有精确的时钟基准
+			p.videoPes.IsKeyFrame = true
+			p.videoPes.ProgramClockReferenceBase = uint64(frame.DTS)
+		} else {
+			p.videoPes.IsKeyFrame = false
+		}
+		// 拼一份只供这个TS流使用的annexB帧：Filtered()把SPS/PPS(/VPS)插到IDR前面，
+		// 但写回的是局部拷贝的Raw，frame本身(以及共享它的其他订阅者)不受影响。
+		annexBFrame := *frame
+		annexBFrame.Raw = p.video.Filtered(frame)
+		if err := p.videoTs.WriteVideoFrame(&annexBFrame, nil, &p.videoPes); err != nil {
+			return err
+		}
+		return p.flush(conn, &p.videoTs, &p.videoPending)
+	})
+}
+
+func (p *Publisher) connect(ctx context.Context) (srt.Conn, error) {
+	if p.Mode == ModeCaller {
+		return srt.Dial("srt", p.Addr, srt.DefaultConfig())
+	}
+	ln, err := srt.Listen("srt", p.Addr, srt.DefaultConfig())
+	if err != nil {
+		return nil, err
+	}
+	defer ln.Close()
+	conn, _, err := ln.Accept(func(req srt.ConnRequest) srt.ConnType {
+		if p.StreamID != "" && req.StreamId() != p.StreamID {
+			return srt.REJECT
+		}
+		return srt.PUBLISH
+	})
+	return conn, err
+}
+
+// flush把ts里已经编码好的TS包追加到对应的pending缓冲，按7个一组(1316字节)发送，
+// 不足一组的尾部留到下一次flush，凑满1316字节再发，避免发出零散的小包。
+// ts/pending是调用方(音频或视频goroutine)独占的一对缓冲，这里只用writeMu
+// 序列化两路goroutine对同一个SRT连接的conn.Write，不保护缓冲本身。
+func (p *Publisher) flush(conn srt.Conn, ts *engine.MemoryTs, pending *util.Buffer) error {
+	for _, b := range ts.BLL.ToBuffers() {
+		*pending = append(*pending, b...)
+	}
+	ts.Reset()
+	p.writeMu.Lock()
+	defer p.writeMu.Unlock()
+	for len(*pending) >= srtPayloadSize {
+		if _, err := conn.Write((*pending)[:srtPayloadSize]); err != nil {
+			return err
+		}
+		*pending = (*pending)[srtPayloadSize:]
+	}
+	return nil
+}
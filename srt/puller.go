@@ -0,0 +1,141 @@
+package srt
+
+import (
+	"context"
+	"io"
+
+	srt "github.com/datarhei/gosrt"
+
+	"m7s.live/engine/v4/codec/mpegts"
+	"m7s.live/engine/v4/track"
+	"m7s.live/engine/v4/util"
+)
+
+// Puller从SRT(listener或caller模式)读入MPEG-TS，解复用出PAT/PMT定位到的音视频PID，
+// 再把裸流重新组装为PES，交给UnknowVideo/音频轨道，走跟RTMP/FLV一样的写入路径。
+type Puller struct {
+	Config
+	video *track.UnknowVideo
+	audio *track.Audio
+
+	pidPMT   uint16
+	pidVideo uint16
+	pidAudio uint16
+	videoPES pesAssembler
+	audioPES pesAssembler
+}
+
+func NewPuller(video *track.UnknowVideo, audio *track.Audio, config Config) *Puller {
+	return &Puller{Config: config, video: video, audio: audio}
+}
+
+// Run建立SRT连接并持续读取，直到连接关闭或ctx取消。
+func (p *Puller) Run(ctx context.Context) error {
+	conn, err := p.connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	buf := make(util.Buffer, srtPayloadSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		p.demux(buf[:n])
+	}
+}
+
+func (p *Puller) connect(ctx context.Context) (srt.Conn, error) {
+	if p.Mode == ModeCaller {
+		return srt.Dial("srt", p.Addr, srt.DefaultConfig())
+	}
+	ln, err := srt.Listen("srt", p.Addr, srt.DefaultConfig())
+	if err != nil {
+		return nil, err
+	}
+	defer ln.Close()
+	conn, _, err := ln.Accept(func(req srt.ConnRequest) srt.ConnType {
+		if p.StreamID != "" && req.StreamId() != p.StreamID {
+			return srt.REJECT
+		}
+		return srt.PUBLISH
+	})
+	return conn, err
+}
+
+// demux把一个SRT载荷(若干个188字节TS包)切开逐包解析，定位PAT/PMT以发现PID，
+// 并把各PID上的PES负载重新拼好后喂给对应的Track。
+func (p *Puller) demux(payload util.Buffer) {
+	for len(payload) >= mpegts.TS_PACKET_SIZE {
+		pkt := payload[:mpegts.TS_PACKET_SIZE]
+		payload = payload[mpegts.TS_PACKET_SIZE:]
+		header, body, err := mpegts.ReadTsHeader(pkt)
+		if err != nil {
+			continue
+		}
+		switch header.Pid {
+		case mpegts.PID_PAT:
+			p.pidPMT, _ = mpegts.ReadPAT(body)
+		case p.pidPMT:
+			p.pidVideo, p.pidAudio, _ = mpegts.ReadPMT(body)
+		case p.pidVideo:
+			if pes, ok := p.videoPES.feed(header, body); ok {
+				p.onVideoPES(pes)
+			}
+		case p.pidAudio:
+			if pes, ok := p.audioPES.feed(header, body); ok {
+				p.onAudioPES(pes)
+			}
+		}
+	}
+}
+
+func (p *Puller) onVideoPES(pes mpegts.MpegTsPESPacket) {
+	p.video.WriteAnnexB(uint32(pes.Header.Pts), uint32(pes.Header.Dts), pes.Payload())
+}
+
+func (p *Puller) onAudioPES(pes mpegts.MpegTsPESPacket) {
+	// TS里的音频是裸ADTS，剥掉ADTS头，剩下的原始AAC帧沿用AVCC入口写入轨道。
+	// 头长不能固定按7字节算：只有protection_absent=1(无CRC)时才是7字节，
+	// protection_absent=0时头后面还带2字节CRC，共9字节，按7字节剥会把CRC残留在AAC帧里。
+	payload := pes.Payload()
+	if hdrLen := adtsHeaderLength(payload); len(payload) > hdrLen {
+		p.audio.WriteAVCC(uint32(pes.Header.Pts), payload[hdrLen:])
+	}
+}
+
+// adtsHeaderLength从ADTS固定头的protection_absent位(第2字节最低位)判断头长：
+// 1表示没有CRC，头长7字节；0表示紧跟着2字节CRC，头长9字节。
+func adtsHeaderLength(payload []byte) int {
+	if len(payload) < 2 || payload[1]&0x01 == 0 {
+		return 9
+	}
+	return 7
+}
+
+// pesAssembler把按PayloadUnitStartIndicator切分的一串TS包重新拼接成一个完整的PES包。
+type pesAssembler struct {
+	buf     util.Buffer
+	started bool
+}
+
+func (a *pesAssembler) feed(header mpegts.MpegTsHeader, body util.Buffer) (pes mpegts.MpegTsPESPacket, complete bool) {
+	if header.PayloadUnitStartIndicator == 1 {
+		if a.started {
+			pes, _ = mpegts.ReadPESPacket(a.buf)
+			complete = true
+		}
+		a.buf = append(util.Buffer{}, body...)
+		a.started = true
+		return
+	}
+	if a.started {
+		a.buf = append(a.buf, body...)
+	}
+	return
+}
@@ -0,0 +1,46 @@
+package srt
+
+import (
+	"testing"
+
+	"m7s.live/engine/v4/codec/mpegts"
+	"m7s.live/engine/v4/util"
+)
+
+// adtsHeaderLength必须按protection_absent位区分7字节/9字节头，固定按7字节剥会把
+// CRC-protected源(protection_absent=0)的2字节CRC残留在剥出来的AAC帧里。
+func TestAdtsHeaderLength(t *testing.T) {
+	cases := []struct {
+		name    string
+		payload []byte
+		want    int
+	}{
+		{"protection_absent=1,no CRC", []byte{0xFF, 0xF1}, 7},
+		{"protection_absent=0,has CRC", []byte{0xFF, 0xF0}, 9},
+		{"too short to inspect", []byte{0xFF}, 9},
+	}
+	for _, c := range cases {
+		if got := adtsHeaderLength(c.payload); got != c.want {
+			t.Errorf("%s: adtsHeaderLength() = %d, want %d", c.name, got, c.want)
+		}
+	}
+}
+
+// pesAssembler.feed应该把被PayloadUnitStartIndicator=0的延续包跨多次TS包累积进同一个
+// 缓冲区，而不是每次都从body重新开始；只有下一次遇到PayloadUnitStartIndicator=1才应该
+// 把已经攒好的这个PES包收尾返回。
+func TestPesAssemblerAccumulatesContinuationPackets(t *testing.T) {
+	var a pesAssembler
+
+	_, complete := a.feed(mpegts.MpegTsHeader{PayloadUnitStartIndicator: 1}, util.Buffer("AAAA"))
+	if complete {
+		t.Fatal("first (start) packet of a PES should not be reported complete")
+	}
+	_, complete = a.feed(mpegts.MpegTsHeader{PayloadUnitStartIndicator: 0}, util.Buffer("BBBB"))
+	if complete {
+		t.Fatal("a continuation packet should not be reported complete")
+	}
+	if got := string(a.buf); got != "AAAABBBB" {
+		t.Errorf("assembled buffer = %q, want %q", got, "AAAABBBB")
+	}
+}
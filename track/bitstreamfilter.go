@@ -0,0 +1,152 @@
+package track
+
+import (
+	"sort"
+
+	"m7s.live/engine/v4/codec"
+	. "m7s.live/engine/v4/common"
+)
+
+// VideoBitstreamFilter对应FFmpeg里的bsf（h264_mp4toannexb、hevc_mp4toannexb、dump_extra等），
+// 在AVCC/FLV/AnnexB这些视图被Flush物化之前，对同一份AVFrame原地做格式转换。
+// 这样订阅端所需的格式转换（比如MPEG-TS要求每个IDR前带SPS/PPS，MP4要求反过来剥掉它们）
+// 只需要挂一个Filter，而不必散落进每一个协议插件里各自实现一遍。
+type VideoBitstreamFilter interface {
+	Filter(vt *Video, frame *AVFrame[NALUSlice])
+}
+
+// AudioBitstreamFilter是音频侧的等价物，例如aac_adtstoasc：剥掉ADTS头，只保留裸AAC帧。
+type AudioBitstreamFilter interface {
+	Filter(at *Audio, frame *AVFrame[AudioSlice])
+}
+
+// AddFilter注册一个会被Filtered()依次调用的视频bsf，调用顺序与注册顺序一致。
+func (vt *Video) AddFilter(f VideoBitstreamFilter) {
+	vt.filters = append(vt.filters, f)
+}
+
+// EnsureH264Mp4ToAnnexBFilter保证这条Video轨道上挂着一个h264_mp4toannexb风格的bsf，
+// 如果已经有同类型的实例(比如HLS和SRT同时从同一路流输出，都需要这个bsf)就直接复用，
+// 不再重复append：两个各自维护参数集缓存的filter实例跑在同一条链上会互相重新分类对方
+// 已经插入的参数集，顺序一多就乱了。
+func (vt *Video) EnsureH264Mp4ToAnnexBFilter() {
+	for _, f := range vt.filters {
+		if _, ok := f.(*h264Mp4ToAnnexB); ok {
+			return
+		}
+	}
+	vt.AddFilter(NewH264Mp4ToAnnexB())
+}
+
+// Filtered对frame.Raw的一份私有拷贝依次跑完注册在这条Video上的所有bsf，返回转换后的结果，
+// 不改写frame本身。AVCC/FLV/CMAF都是直接从共享的vt.Value.Raw物化出来的、会被所有订阅者
+// (RTMP转发、HTTP-FLV、MP4/CMAF录制...)复用的视图，它们不该携带bsf(比如h264_mp4toannexb)
+// 插入的inline SPS/PPS(/VPS)；只有MPEG-TS(HLS/SRT)这类Annex-B格式的输出才需要它，
+// 所以转换结果只应该喂给调用方自己拼的帧，不能写回frame.Raw。
+func (vt *Video) Filtered(frame *AVFrame[NALUSlice]) []NALUSlice {
+	if len(vt.filters) == 0 {
+		return frame.Raw
+	}
+	clone := *frame
+	clone.Raw = append([]NALUSlice{}, frame.Raw...)
+	for _, f := range vt.filters {
+		f.Filter(vt, &clone)
+	}
+	return clone.Raw
+}
+
+// h264Mp4ToAnnexB实现了FFmpeg里同名的bsf：在每个IDR帧前插入缓存的参数集(SPS/PPS，
+// HEVC则是VPS/SPS/PPS)，使原本只含有长度前缀(AVCC/mp4)的码流在输出Annex-B格式
+// （如MPEG-TS、RTP）时也能自描述，不依赖容器另外携带的参数集。
+type h264Mp4ToAnnexB struct {
+	paramaterSets ParamaterSets
+}
+
+// NewH264Mp4ToAnnexB创建一个h264_mp4toannexb风格的VideoBitstreamFilter，
+// 对H.264和H.265码流都适用（参数集类型由vt.CodecID决定）。
+func NewH264Mp4ToAnnexB() VideoBitstreamFilter {
+	return &h264Mp4ToAnnexB{}
+}
+
+// IsParamSet判断一个NALU是否为参数集(SPS/PPS，HEVC下还包括VPS)，而不是携带像素数据的slice。
+// 导出这个分类逻辑，而不是让每个协议插件各自再写一遍同样的switch，是这个文件存在的意义。
+func IsParamSet(codecID codec.VideoCodecID, nalu NALUSlice) bool {
+	if len(nalu) == 0 || len(nalu[0]) == 0 {
+		return false
+	}
+	if codecID == codec.CodecID_H265 {
+		switch (nalu[0][0] >> 1) & 0x3F {
+		case codec.NALU_VPS_HEVC, codec.NALU_SPS_HEVC, codec.NALU_PPS_HEVC:
+			return true
+		}
+		return false
+	}
+	switch nalu[0][0] & 0x1F {
+	case codec.NALU_SPS, codec.NALU_PPS:
+		return true
+	}
+	return false
+}
+
+// paramSetNALType返回一个参数集NALU的实际NAL类型，跟IsParamSet判断用的是同一套位运算：
+// H.265下VPS=32/SPS=33/PPS=34，H.264下SPS=7/PPS=8。
+func paramSetNALType(codecID codec.VideoCodecID, nalu NALUSlice) byte {
+	if codecID == codec.CodecID_H265 {
+		return (nalu[0][0] >> 1) & 0x3F
+	}
+	return nalu[0][0] & 0x1F
+}
+
+// mergeParamSets把fresh里这一帧实际带的参数集按NAL类型合并进existing缓存：同类型的条目
+// 用fresh里的覆盖，fresh没有重新宣告的类型保留existing里原来那一份，而不是被wholesale替换
+// 连同一起冲掉。返回值按NAL类型从小到大排列(H.265下即VPS,SPS,PPS；H.264下即SPS,PPS)，
+// 供avcC/hvcC按位置取值时顺序稳定。
+func mergeParamSets(codecID codec.VideoCodecID, existing, fresh ParamaterSets) ParamaterSets {
+	byType := make(map[byte]NALUSlice, len(existing)+len(fresh))
+	put := func(nalu NALUSlice) {
+		if len(nalu) == 0 || len(nalu[0]) == 0 {
+			return
+		}
+		byType[paramSetNALType(codecID, nalu)] = nalu
+	}
+	for _, nalu := range existing {
+		put(nalu)
+	}
+	for _, nalu := range fresh {
+		put(nalu)
+	}
+	types := make([]byte, 0, len(byType))
+	for t := range byType {
+		types = append(types, t)
+	}
+	sort.Slice(types, func(i, j int) bool { return types[i] < types[j] })
+	merged := make(ParamaterSets, len(types))
+	for i, t := range types {
+		merged[i] = byType[t]
+	}
+	return merged
+}
+
+func (f *h264Mp4ToAnnexB) Filter(vt *Video, frame *AVFrame[NALUSlice]) {
+	media := make([]NALUSlice, 0, len(frame.Raw))
+	var seen ParamaterSets
+	for _, nalu := range frame.Raw {
+		if IsParamSet(vt.CodecID, nalu) {
+			seen = append(seen, nalu)
+			continue
+		}
+		media = append(media, nalu)
+	}
+	// 按NAL类型合并进缓存，而不是整体替换：HEVC编码器通常只在第一个IDR发一次VPS，
+	// 之后的IDR只重复宣告SPS/PPS，wholesale替换会让缓存在下一个IDR就收缩成只剩SPS/PPS，
+	// 后面每个IDR前插入的参数集就再也带不上VPS了——跟mergeParamSets要解决的CMAF那个问题
+	// 是同一个bug。
+	if len(seen) > 0 {
+		f.paramaterSets = mergeParamSets(vt.CodecID, f.paramaterSets, seen)
+	}
+	if !frame.IFrame || len(f.paramaterSets) == 0 {
+		frame.Raw = media
+		return
+	}
+	frame.Raw = append(append([]NALUSlice{}, f.paramaterSets...), media...)
+}
@@ -0,0 +1,76 @@
+package track
+
+import (
+	"testing"
+
+	"m7s.live/engine/v4/codec"
+	. "m7s.live/engine/v4/common"
+)
+
+// mergeParamSets按NAL类型合并，同类型的条目被fresh覆盖，fresh没有重新宣告的类型
+// 保留existing里原来那一份，而不是被wholesale替换掉。
+func TestMergeParamSetsKeepsTypesFreshDidNotReannounce(t *testing.T) {
+	vps := NALUSlice{{0x40, 0x01}}  // naluType 32
+	sps1 := NALUSlice{{0x42, 0x01}} // naluType 33
+	sps2 := NALUSlice{{0x42, 0x02}} // naluType 33，跟sps1同类型但内容不同
+	pps := NALUSlice{{0x44, 0x01}}  // naluType 34
+
+	existing := ParamaterSets{vps, sps1}
+	fresh := ParamaterSets{sps2, pps} // 只重新宣告了SPS/PPS，没有VPS
+
+	merged := mergeParamSets(codec.CodecID_H265, existing, fresh)
+
+	byType := map[byte]NALUSlice{}
+	for _, nalu := range merged {
+		byType[paramSetNALType(codec.CodecID_H265, nalu)] = nalu
+	}
+	if len(byType) != 3 {
+		t.Fatalf("merged has %d distinct NAL types, want 3 (VPS,SPS,PPS)", len(byType))
+	}
+	if got := byType[32]; got[0][1] != vps[0][1] {
+		t.Errorf("VPS should survive from existing when fresh didn't reannounce it")
+	}
+	if got := byType[33]; got[0][1] != sps2[0][1] {
+		t.Errorf("SPS should be the fresh one (sps2), not the stale existing one (sps1)")
+	}
+	if got := byType[34]; got[0][1] != pps[0][1] {
+		t.Errorf("PPS should be the fresh one")
+	}
+}
+
+// h264Mp4ToAnnexB.Filter在第二个IDR只重新宣告SPS/PPS(没有VPS)时，缓存的参数集仍然要
+// 带着第一个IDR宣告过的VPS一起插到这个IDR前面，而不是因为这一帧没重新宣告VPS就把它
+// 从缓存里弄丢——那样这个IDR往后的每一个.ts分片都会缺VPS，解不出来。
+func TestH264Mp4ToAnnexBFilterRetainsVPSAcrossIDRs(t *testing.T) {
+	vt := &Video{CodecID: codec.CodecID_H265}
+	f := NewH264Mp4ToAnnexB()
+
+	vps := NALUSlice{{0x40, 0x01}}
+	sps := NALUSlice{{0x42, 0x01}}
+	pps := NALUSlice{{0x44, 0x01}}
+	idr1Slice := NALUSlice{{0x26, 0x01, 0x80}}
+
+	frame1 := &AVFrame[NALUSlice]{IFrame: true, Raw: []NALUSlice{vps, sps, pps, idr1Slice}}
+	f.Filter(vt, frame1)
+	if len(frame1.Raw) != 4 {
+		t.Fatalf("first IDR: Raw has %d NALUs, want 4 (VPS,SPS,PPS,slice)", len(frame1.Raw))
+	}
+
+	// 第二个IDR编码器只重新宣告了SPS/PPS
+	idr2Slice := NALUSlice{{0x26, 0x01, 0x80}}
+	frame2 := &AVFrame[NALUSlice]{IFrame: true, Raw: []NALUSlice{sps, pps, idr2Slice}}
+	f.Filter(vt, frame2)
+
+	if len(frame2.Raw) != 4 {
+		t.Fatalf("second IDR: Raw has %d NALUs, want 4 (VPS,SPS,PPS,slice); VPS must still be injected", len(frame2.Raw))
+	}
+	foundVPS := false
+	for _, nalu := range frame2.Raw {
+		if paramSetNALType(codec.CodecID_H265, nalu) == 32 {
+			foundVPS = true
+		}
+	}
+	if !foundVPS {
+		t.Error("second IDR is missing VPS even though the first IDR announced it")
+	}
+}
@@ -0,0 +1,84 @@
+package track
+
+import (
+	"testing"
+
+	. "m7s.live/engine/v4/common"
+	"m7s.live/engine/v4/util"
+)
+
+// writeGOP从seq开始往vt当前写入位置连续写n帧，算作同一个GOP(首帧IFrame=true,
+// 其余非IFrame)，每帧Raw是bytesPerFrame字节。首帧调用ComputeGOP，这跟Media.Flush()
+// 在每个GOP边界实际做的事一致；写完每一帧都把写入位置推进到环的下一格，模拟
+// Media.Flush()每帧结束后的前进动作。返回这个GOP首帧所在的环位置和写完之后的下一个seq，
+// 供调用方串联写多个GOP、以及构造"订阅者游标停在某个GOP里"的场景。
+func writeGOP(vt *Video, seq uint32, n int, bytesPerFrame int) (start *util.Ring[AVFrame[NALUSlice]], nextSeq uint32) {
+	for i := 0; i < n; i++ {
+		vt.Value.SeqInTrack = seq
+		vt.Value.IFrame = i == 0
+		if i == 0 {
+			vt.ComputeGOP()
+			start = vt.Ring
+		}
+		vt.Value.Raw = []NALUSlice{{make([]byte, bytesPerFrame)}}
+		vt.Ring = vt.Ring.Next()
+		vt.Value = AVFrame[NALUSlice]{}
+		seq++
+	}
+	return start, seq
+}
+
+// 零值GOPBudget({})文档上承诺"不做淘汰"；这里钉住对应的账本代价也是零——gops不应该
+// 随着GOP数量无限增长，否则流活得越久占用的内存就越大，跟零值Budget想表达的"不限制"
+// 完全是两回事。
+func TestComputeGOPDoesNotTrackGOPsWhenBudgetIsUnconfigured(t *testing.T) {
+	vt := &Video{}
+	vt.Link(util.NewRing[AVFrame[NALUSlice]](64))
+
+	seq := uint32(0)
+	for i := 0; i < 10; i++ {
+		_, seq = writeGOP(vt, seq, 3, 1)
+	}
+
+	if len(vt.gops) != 0 {
+		t.Errorf("gops has %d entries with no budget configured, want 0", len(vt.gops))
+	}
+	if vt.bytes != 0 {
+		t.Errorf("bytes = %d with no budget configured, want 0", vt.bytes)
+	}
+}
+
+// evictUntilWithinBudget超预算时只能通过它自己的redirectSubscribers+Unlink路径回收一个
+// GOP的环槽位：一个游标停在即将被淘汰的GOP里，必须先被改指到幸存的IDR位置、并标记上
+// Discontinuity，而不是留在原地等着被后面新写入的帧悄悄覆盖——那样订阅者既不知道发生了
+// 跳变，读到的还是被顶掉的垃圾数据。
+func TestEvictUntilWithinBudgetRedirectsSubscriberOutOfEvictedGOP(t *testing.T) {
+	vt := &Video{}
+	vt.Link(util.NewRing[AVFrame[NALUSlice]](32))
+	vt.Budget = GOPBudget{Bytes: 8} // 一个5字节的GOP在预算内，两个(10字节)就超了
+
+	gop1Start, seq := writeGOP(vt, 0, 5, 1)
+
+	// 一个读得比较慢的订阅者，游标停在第一个GOP内部（不是GOP起点）
+	cursor := &subscriberCursor{ring: &AVRing[NALUSlice]{Ring: gop1Start.Next()}}
+	vt.subscribersMu.Lock()
+	vt.subscribers = append(vt.subscribers, cursor)
+	vt.subscribersMu.Unlock()
+
+	_, seq = writeGOP(vt, seq, 5, 1) // 第二个GOP：累计5字节，还在预算内，不该触发淘汰
+	if len(vt.gops) != 1 {
+		t.Fatalf("after 2nd GOP starts, len(gops) = %d, want 1 (only the 1st GOP's span recorded so far)", len(vt.gops))
+	}
+	if cursor.Discontinuity() {
+		t.Fatal("subscriber should not be redirected before its GOP is actually over budget and evicted")
+	}
+
+	writeGOP(vt, seq, 5, 1) // 第三个GOP开始：累计达到10字节，超过预算8字节，淘汰最旧的GOP
+
+	if len(vt.gops) != 1 {
+		t.Fatalf("after eviction, len(gops) = %d, want 1 (only the 2nd GOP's span should remain)", len(vt.gops))
+	}
+	if !cursor.Discontinuity() {
+		t.Error("subscriber sitting in the evicted GOP should have been redirected and flagged discontinuous")
+	}
+}
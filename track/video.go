@@ -3,21 +3,66 @@ package track
 import (
 	"bytes"
 	"net"
+	"sync"
+	"time"
 
-	"github.com/Monibuca/engine/v4/codec"
-	. "github.com/Monibuca/engine/v4/common"
-	"github.com/Monibuca/engine/v4/config"
-	"github.com/Monibuca/engine/v4/util"
+	"m7s.live/engine/v4/codec"
+	. "m7s.live/engine/v4/common"
+	"m7s.live/engine/v4/config"
+	"m7s.live/engine/v4/mp4"
+	"m7s.live/engine/v4/util"
 )
 
+// GOPBudget限制GOP缓存最多能占用多少内存、覆盖多长时间，Bytes/Duration各自为0表示不限制。
+// 置零值(零值GOPBudget)等价于完全不做淘汰，由调用方自行决定要不要打开这个限制。
+type GOPBudget struct {
+	Bytes    int
+	Duration time.Duration
+}
+
+// GOPMetrics是GOP缓存当前状态的只读快照，供监控/调试使用。
+type GOPMetrics struct {
+	Bytes    int //当前缓存的AVFrame.Raw累计字节数
+	GOPCount int //当前缓存里完整GOP的个数
+	IDRCount int //当前缓存里IDR帧的个数
+}
+
+// gopSpan记录一个已经收尾的GOP：从start开始的n帧，这n帧Raw的累计字节数是bytes，
+// 用来在超预算时知道该整段淘汰多少帧、释放多少字节，而不需要重新扫描整个环。
+type gopSpan struct {
+	start *util.Ring[AVFrame[NALUSlice]]
+	n     int
+	bytes int
+}
+
 type Video struct {
 	Media[NALUSlice]
-	CodecID     codec.VideoCodecID
-	IDRing      *util.Ring[AVFrame[NALUSlice]] `json:"-"` //最近的关键帧位置，首屏渲染
-	SPSInfo     codec.SPSInfo
-	GOP         int //关键帧间隔
-	nalulenSize int //avcc格式中表示nalu长度的字节数，通常为4
-	idrCount    int //缓存中包含的idr数量
+	CodecID       codec.VideoCodecID
+	IDRing        *util.Ring[AVFrame[NALUSlice]] `json:"-"` //最近的关键帧位置，首屏渲染
+	SPSInfo       codec.SPSInfo
+	GOP           int //关键帧间隔
+	nalulenSize   int //avcc格式中表示nalu长度的字节数，通常为4
+	idrCount      int //缓存中包含的idr数量
+	filters       []VideoBitstreamFilter
+	cmafSeq       uint32              //CMAF分片序号，moof.mfhd要求单调递增
+	cmafParamSets ParamaterSets       //缓存的SPS/PPS(/VPS)，用于生成CMAF的init segment
+	cmafLastDTS   uint32              //上一个CMAF样本的DTS，用来算当前样本的sample_duration
+	sliceSeen     bool                //当前缓冲的AVFrame是否已经收到过属于它的slice(VCL)数据
+	Budget        GOPBudget           //GOP缓存的内存/时长预算，零值表示不限制
+	bytes         int                 //当前缓存的Raw累计字节数，对应Budget.Bytes
+	gops          []gopSpan           //已经收尾的GOP，按从旧到新排列，最旧的在gops[0]
+	subscribersMu sync.Mutex          //保护subscribers这个slice本身：淘汰路径(redirectSubscribers)和各消费者自己的ReadRing/unsubscribe跑在不同goroutine
+	subscribers   []*subscriberCursor //通过ReadRing正在读取的游标，GOP被淘汰时需要帮它们挪窝
+}
+
+// subscriberCursor把一个消费者的读游标(AVRing)跟保护它的锁绑在一起：GOP淘汰时
+// redirectSubscribers(生产者goroutine)要改这个游标的Ring/Discontinuity字段，
+// 同一时间Play()(消费者goroutine)可能正在用Read()/MoveNext()读写同一个字段——
+// subscribersMu只保护subscribers这个slice，并不保护slice里每个元素自己的字段，
+// 两边必须共用这把按游标粒度加的锁才能避免读到撕裂的Ring指针。
+type subscriberCursor struct {
+	mu   sync.Mutex
+	ring *AVRing[NALUSlice]
 }
 
 func (t *Video) Attach() {
@@ -35,41 +80,226 @@ func (t *Video) ComputeGOP() {
 	t.idrCount++
 	if t.IDRing != nil {
 		t.GOP = int(t.Value.SeqInTrack - t.IDRing.Value.SeqInTrack)
-		if l := t.Size - t.GOP - 5; l > 5 {
-			t.Size -= l
-			t.Stream.Debugf("resize %s ringbuffer %d-%d=%d", t.Name, t.Size+l, l, t.Size)
-			//缩小缓冲环节省内存
-			t.Unlink(l).Do(func(v AVFrame[NALUSlice]) {
-				if v.IFrame {
-					t.idrCount--
-				}
-				v.Reset()
-			})
+		// gops/bytes这套账本只是为了给evictUntilWithinBudget提供淘汰依据；零值Budget
+		// (GOPBudget{})文档上承诺的是"不做淘汰"，这时候不应该为了一本永远用不上的账
+		// 而让gops跟着流的生命周期无限增长。
+		if t.Budget.Bytes > 0 || t.Budget.Duration > 0 {
+			n, bytes := ringSpan(t.IDRing, t.GOP)
+			t.gops = append(t.gops, gopSpan{start: t.IDRing, n: n, bytes: bytes})
+			t.bytes += bytes
+			t.evictUntilWithinBudget()
 		}
 	}
 	t.IDRing = t.Ring
 }
 
-func (vt *Video) writeAnnexBSlice(annexb AnnexBFrame) {
+// ringSpan从start开始数n帧(一个GOP的长度)，累加这些帧Raw的字节数。
+func ringSpan(start *util.Ring[AVFrame[NALUSlice]], n int) (count int, bytes int) {
+	for r := start; count < n; count++ {
+		bytes += rawByteLength(r.Value.Raw)
+		r = r.Next()
+	}
+	return
+}
+
+func rawByteLength(raw []NALUSlice) (n int) {
+	for _, nalu := range raw {
+		for _, b := range nalu {
+			n += len(b)
+		}
+	}
+	return
+}
+
+// evictUntilWithinBudget在每个GOP边界检查一次Budget，超出预算时整个GOP、整个GOP地从最旧的
+// 一端淘汰，直到回到预算之内。相比原来按固定个数收缩环(Size-GOP-5)，这样无论GOP有多大，
+// 占用的内存和时长都不会超出配置的budget，不会随着高GOP的流无限制地膨胀。
+func (t *Video) evictUntilWithinBudget() {
+	if t.Budget.Bytes <= 0 && t.Budget.Duration <= 0 {
+		return
+	}
+	// 至少留一个已经收尾的GOP加上正在写的这个GOP，不能把全部缓存都淘汰掉
+	for len(t.gops) > 1 && t.overBudget() {
+		oldest := t.gops[0]
+		t.gops = t.gops[1:]
+		survivingIDRing := t.gops[0].start
+
+		t.Size -= oldest.n
+		t.Stream.Debugf("%s GOP cache over budget, evicting oldest GOP(%d frames,%d bytes), ringbuffer %d", t.Name, oldest.n, oldest.bytes, t.Size)
+		t.redirectSubscribers(oldest.start, oldest.n, survivingIDRing)
+		//idrCount只通过这里被淘汰掉的这一小段环来重新计算，不需要扫描整个缓存
+		t.Unlink(oldest.n).Do(func(v AVFrame[NALUSlice]) {
+			if v.IFrame {
+				t.idrCount--
+			}
+			v.Reset()
+		})
+		t.bytes -= oldest.bytes
+	}
+}
+
+func (t *Video) overBudget() bool {
+	if t.Budget.Bytes > 0 && t.bytes > t.Budget.Bytes {
+		return true
+	}
+	if t.Budget.Duration > 0 && len(t.gops) > 0 {
+		cached := time.Duration(t.Value.DTS-t.gops[0].start.Value.DTS) / 90 * time.Millisecond
+		if cached > t.Budget.Duration {
+			return true
+		}
+	}
+	return false
+}
+
+// redirectSubscribers把所有停留在[from, from+n)这段即将被回收区域里的订阅者游标重新指向
+// survivingIDRing，而不是让它们的Ring指针变成悬空的环节点；subscriber自己在下一次Read时
+// 会发现位置发生了跳变，按丢帧/不连续处理（对HLS/CMAF来说就是另起一个不连续的分片）。
+func (t *Video) redirectSubscribers(from *util.Ring[AVFrame[NALUSlice]], n int, survivingIDRing *util.Ring[AVFrame[NALUSlice]]) {
+	t.subscribersMu.Lock()
+	defer t.subscribersMu.Unlock()
+	for _, c := range t.subscribers {
+		c.mu.Lock()
+		if ringContains(from, n, c.ring.Ring) {
+			c.ring.Ring = survivingIDRing
+			c.ring.Discontinuity = true
+			t.Stream.Warnf("%s slow subscriber's read position was evicted from GOP cache, jumped to seq %d", t.Name, survivingIDRing.Value.SeqInTrack)
+		}
+		c.mu.Unlock()
+	}
+}
+
+func ringContains(start *util.Ring[AVFrame[NALUSlice]], n int, target *util.Ring[AVFrame[NALUSlice]]) bool {
+	r := start
+	for i := 0; i < n; i++ {
+		if r == target {
+			return true
+		}
+		r = r.Next()
+	}
+	return false
+}
+
+// GOPMetrics返回当前GOP缓存的字节数/GOP个数/IDR个数快照。
+func (t *Video) GOPMetrics() GOPMetrics {
+	return GOPMetrics{Bytes: t.bytes, GOPCount: len(t.gops), IDRCount: t.idrCount}
+}
+
+// H.264/H.265的slice NALU类型，用于判断一个NALU是否承载像素数据(VCL)以及是否为关键帧。
+const (
+	naluTypeH264NonIDR = 1 // coded slice of a non-IDR picture
+	naluTypeH264IDR    = 5 // coded slice of an IDR picture
+)
+
+/*
+Access Unit的首个nalu是4字节起始码。
+这里举个例子说明，用JM可以生成这样一段码流（不要使用JM8.6，它在这部分与标准不符），这个码流可以见本楼附件：
+    SPS          （4字节头）
+    PPS          （4字节头）
+    SEI          （4字节头）
+    I0(slice0)     （4字节头）
+    I0(slice1)   （3字节头）
+    P1(slice0)     （4字节头）
+    P1(slice1)   （3字节头）
+    P2(slice0)     （4字节头）
+    P2(slice1)   （3字节头）
+I0(slice0)是序列第一帧（I帧）的第一个slice，是当前Access Unit的首个nalu，所以是4字节头。而I0(slice1)表示第一帧的第二个slice，所以是3字节头。P1(slice0) 、P1(slice1)同理。
+
+起始码长度(3字节还是4字节)并不能用来判断AU边界——上面这段码流一旦被RTP/文件读取器拼接，
+3字节和4字节起始码可能混在一起送进同一次WriteAnnexB调用。真正可靠的判断方法是解析
+slice_header的第一个字段：H.264是first_mb_in_slice(ue(v)编码，值为0时恰好是单个bit'1')，
+H.265是first_slice_segment_in_pic_flag(2字节NAL头之后的第一个bit)。只有当这个字段为真，
+且已经收集到属于上一帧的数据时，才说明上一个Access Unit已经结束，需要先把它切出去。
+*/
+
+// naluInfo解析单个NALU的首部，返回它是否为slice(VCL)单元、是否为IDR/IRAP关键帧，
+// 以及它是否为一个新Access Unit的起始slice。H.264与H.265的NAL头长度不同(1字节/2字节)，
+// 用CodecID加以区分。
+func (vt *Video) naluInfo(nalu AnnexBFrame) (isSlice, isIFrame, newAU bool) {
+	if len(nalu) == 0 {
+		return
+	}
+	if vt.CodecID == codec.CodecID_H265 {
+		naluType := (nalu[0] >> 1) & 0x3F
+		if naluType > 31 { // 非VCL单元：VPS/SPS/PPS/SEI...
+			return
+		}
+		isSlice = true
+		isIFrame = naluType >= 16 && naluType <= 23 // BLA_W_LP..RSV_IRAP_VCL23
+		newAU = len(nalu) > 2 && nalu[2]&0x80 != 0  // first_slice_segment_in_pic_flag
+		return
+	}
+	naluType := nalu[0] & 0x1F
+	if naluType != naluTypeH264NonIDR && naluType != naluTypeH264IDR {
+		return
+	}
+	isSlice = true
+	isIFrame = naluType == naluTypeH264IDR
+	newAU = len(nalu) > 1 && nalu[1]&0x80 != 0 // first_mb_in_slice == 0
+	return
+}
+
+// writeNALU把单个NALU归类并写入当前正在收集的AVFrame。当这个NALU是新Access Unit的
+// 起始slice、且当前帧已经收集了属于上一个AU的slice数据时，先把上一帧切出去(Flush)，
+// 再开始收集新的一帧，这样一次WriteAnnexB调用里挟带多个AU(如上面JM码流的例子)
+// 也能被正确地逐帧切分，不会把多帧的slice混进同一个AVFrame导致GOP计算出错。
+//
+// 这里必须用sliceSeen而不是len(vt.Value.Raw)>0来判断"上一帧是否已经收集到数据"：
+// SPS/PPS/SEI这类非VCL单元也会先被写进vt.Value.Raw，如果只看Raw是否非空，
+// 照着JM示例码流走一遍(SPS,PPS,SEI,I0s0,...)，I0s0作为newAU被识别时Raw已经非空，
+// 会把参数集当成一帧提前切出去，真正的IDR反而丢了它们。
+func (vt *Video) writeNALU(pts, dts uint32, nalu AnnexBFrame) {
+	isSlice, isIFrame, newAU := vt.naluInfo(nalu)
+	if shouldFlushAU(vt.sliceSeen, isSlice, newAU) {
+		vt.Value.PTS, vt.Value.DTS = pts, dts
+		vt.Flush()
+	}
+	if isSlice {
+		vt.sliceSeen = true
+		if isIFrame {
+			vt.Value.IFrame = true
+		}
+	}
+	vt.Value.PTS, vt.Value.DTS = pts, dts
+	vt.WriteSlice(NALUSlice{nalu})
+}
+
+// shouldFlushAU判断是否应该把当前缓冲的AVFrame切出去：只有当这个NALU本身是新AU的
+// 起始slice、且当前帧已经真正收集到过属于上一个AU的slice(VCL)数据时才需要——
+// 非VCL的参数集(SPS/PPS/SEI)不应该单独触发切分，否则会被当成一帧提前切出去。
+func shouldFlushAU(sliceSeen, isSlice, newAU bool) bool {
+	return isSlice && newAU && sliceSeen
+}
+
+func (vt *Video) writeAnnexBSlice(pts, dts uint32, annexb AnnexBFrame) {
 	for len(annexb) > 0 {
 		before, after, found := bytes.Cut(annexb, codec.NALU_Delimiter1)
 		if !found {
-			vt.WriteSlice(NALUSlice{annexb})
+			vt.writeNALU(pts, dts, annexb)
 			return
 		}
 		if len(before) > 0 {
-			vt.WriteSlice(NALUSlice{before})
+			vt.writeNALU(pts, dts, before)
 		}
 		annexb = after
 	}
 }
 
+// WriteAnnexB接受一次完整的AnnexB码流，按Access Unit边界拆分成若干AVFrame写入。
+// pts/dts是整个frame唯一的一对时间戳：调用方约定每次调用只携带一个Access Unit
+// （多个NALU、但属于同一帧画面），就像大多数RTP/TS解复用器那样逐帧调用。
+//
+// writeNALU/writeAnnexBSlice为了正确处理上面Access Unit边界注释里提到的JM示例码流
+// (一次调用里混进了SPS,PPS,SEI,I0,P1,P2多个AU)，额外做了按AU边界切分的兜底，但切出来的
+// 每个AVFrame都只能沿用这次调用唯一的pts,dts——这里没有per-AU的时间戳输入，无法也不应该
+// 凭空插值出各自的时间戳。这个兜底只是为了不把不同帧的slice混进同一个AVFrame搞坏GOP计算，
+// 不是在声明支持多AU输入；调用方必须保证一次调用只喂一个AU，否则这里拆出来的多帧会共享
+// 同一组时间戳。
 func (vt *Video) WriteAnnexB(pts uint32, dts uint32, frame AnnexBFrame) {
 	vt.Stream.Tracef("WriteAnnexB:pts %d,dts %d,len %d", pts, dts, len(frame))
 	for len(frame) > 0 {
 		before, after, found := bytes.Cut(frame, codec.NALU_Delimiter2)
 		if !found {
-			vt.writeAnnexBSlice(frame)
+			vt.writeAnnexBSlice(pts, dts, frame)
 			if len(vt.Value.Raw) > 0 {
 				vt.Value.PTS = pts
 				vt.Value.DTS = dts
@@ -77,7 +307,7 @@ func (vt *Video) WriteAnnexB(pts uint32, dts uint32, frame AnnexBFrame) {
 			return
 		}
 		if len(before) > 0 {
-			vt.writeAnnexBSlice(AnnexBFrame(before))
+			vt.writeAnnexBSlice(pts, dts, AnnexBFrame(before))
 		}
 		frame = after
 	}
@@ -100,8 +330,13 @@ func (vt *Video) Flush() {
 	// 没有实际媒体数据
 	if vt.Value.Raw == nil {
 		vt.Value.Reset()
+		vt.sliceSeen = false
 		return
 	}
+	// 注意：这里不跑bsf链。vt.Value是所有订阅者共享的同一份AVFrame，AVCC/FLV/CMAF这些视图
+	// 都是从它的Raw物化出来的，而这几种格式本身就不应该携带inline的SPS/PPS(/VPS)。需要
+	// bsf转换(比如MPEG-TS的h264_mp4toannexb)的协议应该调用Filtered()拿一份私有的转换结果，
+	// 而不是在这里改写大家共用的Raw。
 	// AVCC格式补完
 	if vt.Value.AVCC == nil && (config.Global.EnableAVCC || config.Global.EnableFLV) {
 		b := []byte{byte(vt.CodecID), 1, 0, 0, 0}
@@ -122,31 +357,122 @@ func (vt *Video) Flush() {
 	if vt.Value.FLV == nil && config.Global.EnableFLV {
 		vt.Value.FillFLV(codec.FLV_TAG_TYPE_VIDEO, vt.Value.DTS/90)
 	}
-	// 下一帧为I帧，即将覆盖
-	if vt.Next().Value.IFrame {
-		// 仅存一枚I帧，需要扩环
-		if vt.idrCount == 1 {
-			if vt.Size < 256 {
-				vt.Link(util.NewRing[AVFrame[NALUSlice]](5)) // 扩大缓冲环
+	// CMAF(fMP4)分片补完：一个样本一个moof+mdat，供DASH/LL-HLS使用
+	if vt.Value.CMAF == nil && config.Global.EnableCMAF {
+		var sets ParamaterSets
+		for _, nalu := range vt.Value.Raw {
+			if IsParamSet(vt.CodecID, nalu) {
+				sets = append(sets, nalu)
 			}
+		}
+		// 按NAL类型(VPS/SPS/PPS)把这一帧带的参数集合并进缓存，而不是整帧wholesale替换：
+		// HEVC编码器通常只在第一个IDR发一次VPS，之后的IDR只重复宣告SPS/PPS，wholesale替换
+		// 会让缓存在下一个IDR就收缩成只剩SPS/PPS两条，CMAFInitSegment/hvcC按位置取值时
+		// 就会把SPS错标成VPS、PPS错标成SPS，真正的VPS也再也拿不回来了。
+		if len(sets) > 0 {
+			vt.cmafParamSets = mergeParamSets(vt.CodecID, vt.cmafParamSets, sets)
+		}
+		vt.cmafSeq++
+		duration := vt.Value.DTS - vt.cmafLastDTS
+		if vt.cmafLastDTS == 0 {
+			duration = 0 // 第一个样本没有上一帧可以参照，时长交给播放器用下一条trun的data_offset推断
+		}
+		vt.cmafLastDTS = vt.Value.DTS
+		vt.Value.AppendCMAF(mp4.FillFragment(1, vt.cmafSeq, &vt.Value, duration))
+	}
+	// 下一个物理环槽位还存着一枚IFrame，说明它所在的GOP还没被evictUntilWithinBudget真正
+	// 淘汰掉——不管这时候idrCount是1还是更多(Budget允许同时缓存多个GOP本就是这个功能的
+	// 意义所在)，这个槽位的数据都还活着，就不能让物理环的自然折返替我们"悄悄"把它覆盖：
+	// 那样停在这段GOP里的订阅者游标永远不会被redirectSubscribers发现、也收不到
+	// Discontinuity，读到的会是已经被新帧顶掉的数据。只有evictUntilWithinBudget
+	// (redirectSubscribers通知游标之后再Unlink收缩环)才允许真正回收一个GOP的环槽位，
+	// 这里始终只扩环，不做任何回收判断。
+	if next := vt.Next(); next.Value.IFrame {
+		if vt.Size < 256 {
+			vt.Link(util.NewRing[AVFrame[NALUSlice]](5)) // 扩大缓冲环
 		} else {
+			// 环已经到了上限(256)扩不动了，下一次Media.Flush()推进指针就会覆盖这枚IFrame，
+			// idrCount要跟着减一，不然GOPMetrics().IDRCount只增不减，跟缓存里实际还活着的
+			// IDR数量脱节。
 			vt.idrCount--
 		}
 	}
 	vt.Media.Flush()
+	vt.sliceSeen = false
 }
-func (vt *Video) ReadRing() *AVRing[NALUSlice] {
+
+// CMAFInitSegment返回当前编解码参数对应的CMAF/fMP4初始化分片(ftyp+moov)，CMAF/LL-HLS的
+// 订阅端需要先拿到它才能解析后续由Flush产出的moof+mdat分片。audio为nil表示只有视频。
+// 应该在拿到第一个参数集(首个IDR)之后、或者cmafParamSets变化之后重新调用一次。
+func (vt *Video) CMAFInitSegment(audio *Audio) []byte {
+	var asc *codec.AudioSpecificConfig
+	if audio != nil {
+		asc = audio.AudioSpecificConfig
+	}
+	return mp4.InitSegment(vt.CodecID, vt.SPSInfo, vt.cmafParamSets, asc)
+}
+
+// ReadRing订阅这条Video轨道的GOP缓存，返回一个从最近一个IDR开始读的游标。不直接返回
+// 内部的*AVRing[NALUSlice]，是因为GOP淘汰(redirectSubscribers)会并发改写它的Ring/
+// Discontinuity字段——调用方应该用Read()/MoveNext()读取，不要绕开subscriberCursor自己持有
+// *AVRing。
+func (vt *Video) ReadRing() *subscriberCursor {
 	vr := util.Clone(vt.AVRing)
 	vr.Ring = vt.IDRing
-	return vr
+	c := &subscriberCursor{ring: vr}
+	vt.subscribersMu.Lock()
+	vt.subscribers = append(vt.subscribers, c)
+	vt.subscribersMu.Unlock()
+	return c
+}
+
+// Read返回游标当前位置的帧，持有跟redirectSubscribers共用的那把锁，
+// 可以在GOP淘汰随时发生的情况下安全调用。
+func (c *subscriberCursor) Read() *AVFrame[NALUSlice] {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ring.Read()
+}
+
+// MoveNext把游标挪到环里的下一帧。
+func (c *subscriberCursor) MoveNext() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ring.MoveNext()
 }
+
+// Discontinuity报告这个游标的位置自上次调用以来是否被GOP淘汰重定向过，并清除这个标记；
+// 调用方(比如HLS/CMAF)应该在返回true时另起一个不连续的分片。
+func (c *subscriberCursor) Discontinuity() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	d := c.ring.Discontinuity
+	c.ring.Discontinuity = false
+	return d
+}
+
+// unsubscribe把c从subscribers里摘掉，GOP淘汰时就不会再去挪一个已经不在读的游标。
+func (vt *Video) unsubscribe(c *subscriberCursor) {
+	vt.subscribersMu.Lock()
+	defer vt.subscribersMu.Unlock()
+	for i, s := range vt.subscribers {
+		if s == c {
+			vt.subscribers = append(vt.subscribers[:i], vt.subscribers[i+1:]...)
+			return
+		}
+	}
+}
+
 func (vt *Video) Play(onVideo func(*AVFrame[NALUSlice]) error) {
-	vr := vt.ReadRing()
-	for vp := vr.Read(); vt.Stream.Err() == nil; vp = vr.Read() {
+	c := vt.ReadRing()
+	defer vt.unsubscribe(c)
+	vp := c.Read()
+	for vt.Stream.Err() == nil {
 		if onVideo(vp) != nil {
 			break
 		}
-		vr.MoveNext()
+		c.MoveNext()
+		vp = c.Read()
 	}
 }
 
@@ -155,23 +481,52 @@ type UnknowVideo struct {
 	VideoTrack
 }
 
-/*
-Access Unit的首个nalu是4字节起始码。
-这里举个例子说明，用JM可以生成这样一段码流（不要使用JM8.6，它在这部分与标准不符），这个码流可以见本楼附件：
-    SPS          （4字节头）
-    PPS          （4字节头）
-    SEI          （4字节头）
-    I0(slice0)     （4字节头）
-    I0(slice1)   （3字节头）
-    P1(slice0)     （4字节头）
-    P1(slice1)   （3字节头）
-    P2(slice0)     （4字节头）
-    P2(slice1)   （3字节头）
-I0(slice0)是序列第一帧（I帧）的第一个slice，是当前Access Unit的首个nalu，所以是4字节头。而I0(slice1)表示第一帧的第二个slice，所以是3字节头。P1(slice0) 、P1(slice1)同理。
-
-*/
+// WriteAVCC的入口能靠AVCC序列头(IsSequence)探测编解码器，AnnexB输入(SRT/TS这类没有
+// 序列头概念的来源)没有这个机会，只能从码流本身嗅探第一个SPS NALU来判断H.264还是H.265，
+// 一旦探测出来就立即建出具体Track并把这一帧转发给它，此后都由具体Track直接处理。
 func (vt *UnknowVideo) WriteAnnexB(pts uint32, dts uint32, frame AnnexBFrame) {
+	if vt.VideoTrack == nil {
+		codecID, ok := sniffAnnexBCodec(frame)
+		if !ok {
+			return // 还没见到SPS，无法判断编码，先丢弃等下一个包
+		}
+		if vt.Name == "" {
+			vt.Name = codecID.String()
+		}
+		switch codecID {
+		case codec.CodecID_H264:
+			vt.VideoTrack = NewH264(vt.Stream)
+		case codec.CodecID_H265:
+			vt.VideoTrack = NewH265(vt.Stream)
+		default:
+			vt.Stream.Error("video codecID not support: ", codecID)
+			return
+		}
+	}
+	vt.VideoTrack.WriteAnnexB(pts, dts, frame)
+}
 
+// sniffAnnexBCodec在一段AnnexB码流里找第一个SPS NALU来判断编码格式：H.264 SPS的
+// NALU header是1字节，nal_unit_type(低5位)=7；H.265 SPS的NALU header是2字节，
+// nal_unit_type(去掉forbidden_zero_bit后的高6位)=33。找不到SPS就返回false，
+// 调用方应该先丢弃这一包，等后续包里带着SPS再重新嗅探。
+func sniffAnnexBCodec(frame AnnexBFrame) (codec.VideoCodecID, bool) {
+	for len(frame) > 0 {
+		_, after, found := bytes.Cut(frame, codec.NALU_Delimiter1)
+		if !found {
+			return 0, false
+		}
+		if len(after) > 0 {
+			if after[0]&0x1F == codec.NALU_SPS {
+				return codec.CodecID_H264, true
+			}
+			if len(after) > 1 && (after[0]>>1)&0x3F == codec.NALU_SPS_HEVC {
+				return codec.CodecID_H265, true
+			}
+		}
+		frame = after
+	}
+	return 0, false
 }
 
 func (vt *UnknowVideo) WriteAVCC(ts uint32, frame AVCCFrame) {
@@ -198,4 +553,4 @@ func (vt *UnknowVideo) WriteAVCC(ts uint32, frame AVCCFrame) {
 	} else {
 		vt.VideoTrack.WriteAVCC(ts, frame)
 	}
-}
\ No newline at end of file
+}
@@ -0,0 +1,146 @@
+package track
+
+import (
+	"testing"
+
+	"m7s.live/engine/v4/codec"
+	. "m7s.live/engine/v4/common"
+	"m7s.live/engine/v4/util"
+)
+
+// naluInfo分类下文JM示例码流里出现的每一种NALU类型，对应video.go里Access Unit边界
+// 注释描述的那段码流：SPS,PPS,SEI,I0(slice0,slice1),P1(slice0,slice1),P2(slice0,slice1)。
+func TestNaluInfoJMExample(t *testing.T) {
+	vt := &Video{}
+	cases := []struct {
+		name     string
+		nalu     []byte
+		isSlice  bool
+		isIFrame bool
+		newAU    bool
+	}{
+		{"SPS", []byte{0x07}, false, false, false},
+		{"PPS", []byte{0x08}, false, false, false},
+		{"SEI", []byte{0x06}, false, false, false},
+		{"I0-slice0", []byte{0x05, 0x80}, true, true, true},
+		{"I0-slice1", []byte{0x05, 0x00}, true, true, false},
+		{"P1-slice0", []byte{0x01, 0x80}, true, false, true},
+		{"P1-slice1", []byte{0x01, 0x00}, true, false, false},
+		{"P2-slice0", []byte{0x01, 0x80}, true, false, true},
+		{"P2-slice1", []byte{0x01, 0x00}, true, false, false},
+	}
+	for _, c := range cases {
+		isSlice, isIFrame, newAU := vt.naluInfo(AnnexBFrame(c.nalu))
+		if isSlice != c.isSlice || isIFrame != c.isIFrame || newAU != c.newAU {
+			t.Errorf("%s: naluInfo() = (%v,%v,%v), want (%v,%v,%v)",
+				c.name, isSlice, isIFrame, newAU, c.isSlice, c.isIFrame, c.newAU)
+		}
+	}
+}
+
+// naluInfo的H.265分支用的是2字节NAL头，newAU靠first_slice_segment_in_pic_flag
+// (NAL头之后第一个字节的最高位)判断，跟H.264的first_mb_in_slice是两套完全不同的位运算，
+// 之前只覆盖了H.264分支，这里补上H.265：VPS/SPS/PPS/SEI都应该被判定为非slice，
+// IDR(naluType 16..23)和非IDR(这里用TRAIL_R=1)都应该正确识别isIFrame和newAU。
+func TestNaluInfoH265(t *testing.T) {
+	vt := &Video{CodecID: codec.CodecID_H265}
+	cases := []struct {
+		name     string
+		nalu     []byte
+		isSlice  bool
+		isIFrame bool
+		newAU    bool
+	}{
+		{"VPS", []byte{0x40, 0x01}, false, false, false},
+		{"SPS", []byte{0x42, 0x01}, false, false, false},
+		{"PPS", []byte{0x44, 0x01}, false, false, false},
+		{"SEI", []byte{0x4E, 0x01}, false, false, false},
+		{"IDR-slice0", []byte{0x26, 0x01, 0x80}, true, true, true},
+		{"IDR-slice1", []byte{0x26, 0x01, 0x00}, true, true, false},
+		{"P-slice0", []byte{0x02, 0x01, 0x80}, true, false, true},
+		{"P-slice1", []byte{0x02, 0x01, 0x00}, true, false, false},
+	}
+	for _, c := range cases {
+		isSlice, isIFrame, newAU := vt.naluInfo(AnnexBFrame(c.nalu))
+		if isSlice != c.isSlice || isIFrame != c.isIFrame || newAU != c.newAU {
+			t.Errorf("%s: naluInfo() = (%v,%v,%v), want (%v,%v,%v)",
+				c.name, isSlice, isIFrame, newAU, c.isSlice, c.isIFrame, c.newAU)
+		}
+	}
+}
+
+// newTestVideo给一个Video挂上一个真正的环，让writeNALU实际触发的Flush()/Media.Flush()
+// 有地方落，不会因为vt.Next()访问到一个还没Link过的空环而panic。
+func newTestVideo() *Video {
+	vt := &Video{}
+	vt.Link(util.NewRing[AVFrame[NALUSlice]](8))
+	return vt
+}
+
+// TestWriteNALUDoesNotSplitParamSetsFromIDR驱动真正的vt.writeNALU(而不是像过去那样在
+// 测试里重新实现一遍sliceSeen+shouldFlushAU的累积/判断逻辑)走一遍JM示例码流：参数集
+// (SPS/PPS/SEI)必须先于I0的两个slice积累在同一个AVFrame里，不能被I0-slice0的newAU
+// 误判成"上一帧已收集到数据"而提前切出去；P1-slice0才应该真正触发一次Flush。
+// 这样写NALU里"sliceSeen赋值"和"flush检查"的先后顺序一旦被写反，这里就能测出来。
+func TestWriteNALUDoesNotSplitParamSetsFromIDR(t *testing.T) {
+	vt := newTestVideo()
+	nalus := []struct {
+		name string
+		nalu []byte
+	}{
+		{"SPS", []byte{0x07}},
+		{"PPS", []byte{0x08}},
+		{"SEI", []byte{0x06}},
+		{"I0-slice0", []byte{0x05, 0x80}},
+		{"I0-slice1", []byte{0x05, 0x00}},
+		{"P1-slice0", []byte{0x01, 0x80}},
+	}
+
+	var rawLenBeforeFlush int
+	for _, n := range nalus {
+		if n.name == "P1-slice0" {
+			rawLenBeforeFlush = len(vt.Value.Raw)
+		}
+		vt.writeNALU(1000, 1000, AnnexBFrame(n.nalu))
+	}
+
+	// P1-slice0触发flush之前，I0这一帧应该完整带着SPS,PPS,SEI和它自己的两个slice。
+	if rawLenBeforeFlush != 5 {
+		t.Fatalf("before P1-slice0, accumulated frame has %d NALUs, want 5 (SPS,PPS,SEI,I0-slice0,I0-slice1)", rawLenBeforeFlush)
+	}
+	// flush发生后，P1-slice0应该已经被写进下一帧，而不是继续堆在刚flush出去的I0里。
+	if got := len(vt.Value.Raw); got != 1 {
+		t.Errorf("after P1-slice0 flush, new frame has %d NALUs, want 1", got)
+	}
+	if !vt.sliceSeen {
+		t.Error("sliceSeen should be true right after writing P1-slice0's own slice")
+	}
+}
+
+// TestWriteAnnexBSharesTimestampAcrossAUsInOneCall驱动真正的vt.WriteAnnexB，钉住一个
+// 有意为之的限制：一次调用只带一对pts,dts，即便JM示例码流那样的输入里混进了多个AU
+// (SPS,PPS,SEI,I0,P1,P2)，按AU边界拆出来的每一帧也只能沿用调用方传入的那一对时间戳。
+func TestWriteAnnexBSharesTimestampAcrossAUsInOneCall(t *testing.T) {
+	const pts, dts = uint32(1000), uint32(900)
+	frame := AnnexBFrame(append(append(append(append(append(append(
+		append(append([]byte{}, codec.NALU_Delimiter1...), 0x07),
+		append(codec.NALU_Delimiter1, 0x08)...),
+		append(codec.NALU_Delimiter1, 0x06)...),
+		append(codec.NALU_Delimiter1, 0x05, 0x80)...),
+		append(codec.NALU_Delimiter1, 0x05, 0x00)...),
+		append(codec.NALU_Delimiter1, 0x01, 0x80)...),
+		append(codec.NALU_Delimiter1, 0x01, 0x00)...,
+	))
+
+	vt := newTestVideo()
+	vt.WriteAnnexB(pts, dts, frame)
+
+	// P1(第二个AU)触发了一次flush，把I0连同它的参数集切出去；P1自己的两个slice
+	// 还停留在vt.Value里，沿用的是这次调用唯一的那一对pts,dts，而不是凭空插值出来的。
+	if vt.Value.PTS != pts || vt.Value.DTS != dts {
+		t.Errorf("trailing AU timestamp = (%d,%d), want (%d,%d)", vt.Value.PTS, vt.Value.DTS, pts, dts)
+	}
+	if got := len(vt.Value.Raw); got != 2 {
+		t.Errorf("trailing AU has %d NALUs, want 2 (P1-slice0,P1-slice1)", got)
+	}
+}